@@ -1,8 +1,20 @@
 package fems
 
 import (
+	"bufio"
+	"context"
 	_ "embed"
 	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 
 	"encoding/json"
 	"net/url"
@@ -11,26 +23,125 @@ import (
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	common_tls "github.com/influxdata/telegraf/plugins/common/tls"
 	"github.com/influxdata/telegraf/plugins/inputs"
 )
 
 //go:embed sample.conf
 var sampleConfig string
 
+const (
+	defaultReconnectMinBackoff = config.Duration(5 * time.Second)
+	defaultReconnectMaxBackoff = config.Duration(2 * time.Minute)
+	defaultPingInterval        = config.Duration(30 * time.Second)
+
+	// defaultRPCTimeout bounds how long sendRequest waits for a matching
+	// response before giving up and letting the caller treat the connection
+	// as dead.
+	defaultRPCTimeout = 10 * time.Second
+)
+
 type Fems struct {
-	URL         string          `toml:"url"`
-	Password    string          `toml:"password"`
-	Channels    []string        `toml:"channels"`
+	URL                 string            `toml:"url"`
+	Scheme              string            `toml:"scheme"`
+	Password            string            `toml:"password"`
+	Channels            []string          `toml:"channels"`
+	ChannelsFile        string            `toml:"channels_file"`
+	ChannelConfigs      []ChannelConfig   `toml:"channel"`
+	ComponentTag        bool              `toml:"component_tag"`
+	ChannelsFromNature  []string          `toml:"channels_from_nature"`
+	ReconnectMinBackoff config.Duration   `toml:"reconnect_min_backoff"`
+	ReconnectMaxBackoff config.Duration   `toml:"reconnect_max_backoff"`
+	PingInterval        config.Duration   `toml:"ping_interval"`
+	HTTPHeaders         map[string]string `toml:"http_headers"`
+	HTTPUsername        string            `toml:"http_username"`
+	HTTPPassword        string            `toml:"http_password"`
+	BearerToken         string            `toml:"bearer_token"`
+	common_tls.ClientConfig
+
 	Log         telegraf.Logger `toml:"-"`
 	cnt         int
-	conn        *websocket.Conn
 	is_stopping bool
 	acc         telegraf.Accumulator
+
+	// connMu guards conn itself: connect() swaps it on every dial/cleanup,
+	// while sendRequest (called from both connect() and, via ReloadChannels,
+	// the channels_file watcher goroutine) and pingLoop only ever read it
+	// through getConn(). writeMu additionally serializes the actual writes,
+	// since gorilla/websocket forbids concurrent writers on one connection.
+	connMu  sync.Mutex
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+
+	backoffMu sync.Mutex
+	backoff   time.Duration
+
+	channelsMu sync.Mutex
+
+	sighup    chan os.Signal
+	stopWatch chan struct{}
+
+	// dispatchMu guards pending and handlers, which together demultiplex the
+	// single reader goroutine's frames: pending routes responses (frames
+	// carrying an "id") back to the sendRequest call waiting on them, while
+	// handlers routes notifications (frames carrying only a "method") to the
+	// per-method callback that knows how to process them.
+	dispatchMu sync.Mutex
+	pending    map[string]chan *RpcResponse
+	handlers   map[string]func(msg []byte)
+
+	channelConfig map[string]ChannelConfig
+
+	// edgeConfig caches the getEdgeConfig response fetched once per
+	// connection. It is written by the connect() goroutine while readLoop
+	// already runs on its own goroutine, and emitChannel reads it from that
+	// readLoop goroutine without locking; the write happens before
+	// subscribeChannels is sent on the connection.
+	edgeConfig *EdgeConfig
+}
+
+// EdgeConfig mirrors the subset of FEMS's getEdgeConfig response used to
+// validate configured channels and enrich metrics with static metadata.
+type EdgeConfig struct {
+	Components map[string]EdgeComponentConfig `json:"components"`
+}
+
+type EdgeComponentConfig struct {
+	Alias     string                       `json:"alias"`
+	FactoryId string                       `json:"factoryId"`
+	Natures   []string                     `json:"natures"`
+	Channels  map[string]EdgeChannelConfig `json:"channels"`
+}
+
+type EdgeChannelConfig struct {
+	Unit string `json:"unit"`
+}
+
+// ChannelConfig customizes how a single FEMS channel is turned into a
+// metric: which measurement/tags it is routed to, what its field should be
+// named, and how its raw JSON value should be coerced and scaled.
+type ChannelConfig struct {
+	Name        string            `toml:"name"`
+	Rename      string            `toml:"rename"`
+	Measurement string            `toml:"measurement"`
+	Tags        map[string]string `toml:"tags"`
+	Type        string            `toml:"type"`
+	Scale       float64           `toml:"scale"`
+	Offset      float64           `toml:"offset"`
 }
 
 type RpcResponse struct {
-	Id    string    `json:"id"`
-	Error *ErrorMsg `json:"error"`
+	Id     string          `json:"id"`
+	Error  *ErrorMsg       `json:"error"`
+	Result json.RawMessage `json:"result"`
+}
+
+// rpcEnvelope is decoded first to tell a response (has "id") apart from a
+// notification (has only "method").
+type rpcEnvelope struct {
+	Id     string `json:"id"`
+	Method string `json:"method"`
 }
 
 type ErrorMsg struct {
@@ -76,26 +187,179 @@ func (f *Fems) Init() error {
 		return errors.New("FEMS URL missing")
 	}
 
-	if len(f.Channels) == 0 {
+	if f.ChannelsFile != "" {
+		channels, err := loadChannelsFile(f.ChannelsFile)
+		if err != nil {
+			return fmt.Errorf("reading channels_file: %w", err)
+		}
+		f.Channels = channels
+	}
+
+	if len(f.Channels) == 0 && len(f.ChannelsFromNature) == 0 {
 		return errors.New("No FEMS channels configured")
 	}
 
+	if f.ReconnectMinBackoff <= 0 {
+		f.ReconnectMinBackoff = defaultReconnectMinBackoff
+	}
+
+	if f.ReconnectMaxBackoff <= 0 {
+		f.ReconnectMaxBackoff = defaultReconnectMaxBackoff
+	}
+
+	if f.ReconnectMaxBackoff < f.ReconnectMinBackoff {
+		return errors.New("reconnect_max_backoff must be >= reconnect_min_backoff")
+	}
+
+	if f.PingInterval <= 0 {
+		f.PingInterval = defaultPingInterval
+	}
+
+	if f.Scheme == "" {
+		f.Scheme = "ws"
+	}
+	if f.Scheme != "ws" && f.Scheme != "wss" {
+		return fmt.Errorf("invalid scheme %q, must be \"ws\" or \"wss\"", f.Scheme)
+	}
+
+	f.pending = make(map[string]chan *RpcResponse)
+	f.handlers = map[string]func(msg []byte){
+		"edgeRpc": f.onEdgeRpcNotification,
+	}
+
+	if len(f.ChannelConfigs) > 0 {
+		f.channelConfig = make(map[string]ChannelConfig, len(f.ChannelConfigs))
+		for _, c := range f.ChannelConfigs {
+			if c.Name == "" {
+				return errors.New("inputs.fems.channel requires a name")
+			}
+			switch c.Type {
+			case "", "integer", "float", "string", "boolean":
+			default:
+				return fmt.Errorf("channel %q: invalid type %q", c.Name, c.Type)
+			}
+			f.channelConfig[c.Name] = c
+		}
+	}
+
 	return nil
 }
 
+// dialURL returns the WebSocket URL to dial, honoring an explicit ws(s)://
+// scheme already present in URL and otherwise falling back to Scheme+Host.
+func (f *Fems) dialURL() string {
+	if strings.Contains(f.URL, "://") {
+		return f.URL
+	}
+	u := url.URL{Scheme: f.Scheme, Host: f.URL}
+	return u.String()
+}
+
+// dialerAndHeader builds the websocket.Dialer (with TLS config applied) and
+// the HTTP headers used for the upgrade request, so the plugin can talk to a
+// FEMS behind a TLS-terminating/authenticating reverse proxy.
+func (f *Fems) dialerAndHeader() (*websocket.Dialer, http.Header, error) {
+	tlsCfg, err := f.ClientConfig.TLSConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("TLS config: %w", err)
+	}
+
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 45 * time.Second,
+		TLSClientConfig:  tlsCfg,
+	}
+
+	header := http.Header{}
+	for key, value := range f.HTTPHeaders {
+		header.Set(key, value)
+	}
+	switch {
+	case f.BearerToken != "":
+		header.Set("Authorization", "Bearer "+f.BearerToken)
+	case f.HTTPUsername != "" || f.HTTPPassword != "":
+		req := &http.Request{Header: header}
+		req.SetBasicAuth(f.HTTPUsername, f.HTTPPassword)
+	}
+
+	return dialer, header, nil
+}
+
 func (f *Fems) Start(acc telegraf.Accumulator) error {
 	f.Log.Info("Start")
 	f.acc = acc
 	go f.connect()
+
+	if f.ChannelsFile != "" {
+		f.sighup = make(chan os.Signal, 1)
+		f.stopWatch = make(chan struct{})
+		signal.Notify(f.sighup, syscall.SIGHUP)
+		go f.watchChannelsFile()
+	}
+
 	return nil
 }
 
 func (f *Fems) Stop() {
 	f.Log.Info("Stop")
 	f.is_stopping = true
+	if f.sighup != nil {
+		signal.Stop(f.sighup)
+		close(f.stopWatch)
+	}
 	f.cleanup()
 }
 
+// watchChannelsFile reloads ChannelsFile on SIGHUP so operators can add or
+// remove channels without restarting telegraf.
+func (f *Fems) watchChannelsFile() {
+	for {
+		select {
+		case <-f.stopWatch:
+			return
+		case <-f.sighup:
+			f.Log.Info("SIGHUP received, reloading channels from ", f.ChannelsFile)
+			channels, err := loadChannelsFile(f.ChannelsFile)
+			if err != nil {
+				f.Log.Error("failed to reload channels_file: ", err)
+				continue
+			}
+			if err := f.ReloadChannels(channels); err != nil {
+				f.Log.Error("failed to apply reloaded channels: ", err)
+			}
+		}
+	}
+}
+
+// loadChannelsFile reads one FEMS channel address per line, ignoring blank
+// lines and lines starting with '#'.
+func loadChannelsFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var channels []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		channels = append(channels, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("%s contains no channels", path)
+	}
+
+	return channels, nil
+}
+
 func (f *Fems) Gather(acc telegraf.Accumulator) error {
 	return nil
 }
@@ -109,68 +373,183 @@ func getRequest(method string) RpcReq {
 	return r
 }
 
+// jitter returns wait extended by +/-25% random jitter.
+func jitter(wait time.Duration) time.Duration {
+	delta := float64(wait) * 0.25
+	return wait + time.Duration(delta*(2*rand.Float64()-1))
+}
+
 func (f *Fems) connect() {
+	f.setBackoff(time.Duration(f.ReconnectMinBackoff))
 	first := true
+	var readDone chan struct{}
 	for {
 		if first == false {
 			f.cleanup()
+			if readDone != nil {
+				<-readDone
+			}
 			if f.is_stopping {
 				return
 			}
-			wait := 10 * time.Second
+			wait := jitter(f.getBackoff())
 			f.Log.Warn("Connection failure reconnecting in ", wait)
 			time.Sleep(wait)
+
+			f.growBackoff()
 		}
 
 		first = false
 
-		u := url.URL{Scheme: "ws", Host: f.URL}
-		f.Log.Info("Connecting to ", u.String())
+		target := f.dialURL()
+		f.Log.Info("Connecting to ", target)
 
-		ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+		dialer, header, err := f.dialerAndHeader()
+		if err != nil {
+			f.Log.Error("dialer setup:", err)
+			continue
+		}
+
+		ws, _, err := dialer.Dial(target, header)
 		if err != nil {
 			f.Log.Error("dial:", err)
 			continue
 		}
-		f.conn = ws
+		ws.SetReadDeadline(time.Now().Add(2 * time.Duration(f.PingInterval)))
+		ws.SetPongHandler(func(string) error {
+			ws.SetReadDeadline(time.Now().Add(2 * time.Duration(f.PingInterval)))
+			return nil
+		})
+		f.setConn(ws)
+
+		// Start reading before the handshake RPCs below so their
+		// sendRequest calls actually get a response instead of blocking
+		// until defaultRPCTimeout and failing.
+		readDone = make(chan struct{})
+		go func() {
+			f.readLoop()
+			close(readDone)
+		}()
 
 		if f.try_login() == false {
 			continue
 		}
 
+		if f.try_get_edge_config() == false {
+			continue
+		}
+
 		if f.try_subscribe_channels() == false {
 			continue
 		}
 
-		f.try_handel_msgs_forever()
+		pingDone := make(chan struct{})
+		go f.pingLoop(pingDone)
+
+		<-readDone
+
+		close(pingDone)
 	}
 
 }
 
-func (f *Fems) try_subscribe_channels() bool {
-	req := f.get_subscribe_channels_request()
-	err := f.conn.WriteJSON(req)
-	if err != nil {
-		f.Log.Error("failed to send subscribe channels:", err)
-		return false
+func (f *Fems) getBackoff() time.Duration {
+	f.backoffMu.Lock()
+	defer f.backoffMu.Unlock()
+	return f.backoff
+}
+
+func (f *Fems) setBackoff(d time.Duration) {
+	f.backoffMu.Lock()
+	f.backoff = d
+	f.backoffMu.Unlock()
+}
+
+func (f *Fems) growBackoff() {
+	f.backoffMu.Lock()
+	defer f.backoffMu.Unlock()
+	f.backoff *= 2
+	if max := time.Duration(f.ReconnectMaxBackoff); f.backoff > max {
+		f.backoff = max
 	}
+}
 
-	_, msg, err := f.conn.ReadMessage()
-	if err != nil {
-		f.Log.Info("read subscribe response:", err)
-		return false
+// getConn returns the current connection, or nil if none is established
+// (e.g. while backed off waiting to reconnect).
+func (f *Fems) getConn() *websocket.Conn {
+	f.connMu.Lock()
+	defer f.connMu.Unlock()
+	return f.conn
+}
+
+// setConn installs conn as the current connection. Within the plugin, only
+// connect() and cleanup() call this.
+func (f *Fems) setConn(conn *websocket.Conn) {
+	f.connMu.Lock()
+	f.conn = conn
+	f.connMu.Unlock()
+}
+
+// writeJSON writes v to the current connection, serialized against any
+// other writer (gorilla/websocket forbids concurrent writes on one
+// connection), failing instead of panicking if there is no live connection.
+func (f *Fems) writeJSON(v any) error {
+	conn := f.getConn()
+	if conn == nil {
+		return errors.New("not connected")
 	}
 
-	var resp RpcResponse
-	err = json.Unmarshal(msg, &resp)
-	if err != nil {
-		f.Log.Info("could not parse subscribe response:", err)
-		f.Log.Info("data was:", string(msg))
-		return false
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+	return conn.WriteJSON(v)
+}
+
+// writeControl writes a WebSocket control frame to the current connection,
+// serialized the same way as writeJSON.
+func (f *Fems) writeControl(messageType int, data []byte, deadline time.Time) error {
+	conn := f.getConn()
+	if conn == nil {
+		return errors.New("not connected")
+	}
+
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+	return conn.WriteControl(messageType, data, deadline)
+}
+
+// pingLoop writes a control ping at PingInterval until stopped or the
+// connection is no longer writable. If a ping fails to send, the connection
+// is torn down so the reconnect loop in connect() takes over; missed pongs
+// are detected via the read deadline extended in the pong handler registered
+// in connect().
+func (f *Fems) pingLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(f.PingInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			deadline := time.Now().Add(time.Duration(f.PingInterval))
+			if err := f.writeControl(websocket.PingMessage, nil, deadline); err != nil {
+				f.Log.Warn("ping failed, closing connection: ", err)
+				if conn := f.getConn(); conn != nil {
+					conn.Close()
+				}
+				return
+			}
+		}
 	}
+}
 
-	if resp.Id != req.Id {
-		f.Log.Error("unexpected response id. sent: ", req, " received: ", resp)
+func (f *Fems) try_subscribe_channels() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRPCTimeout)
+	defer cancel()
+
+	resp, err := f.sendRequest(ctx, "edgeRpc", f.edgeRpcParams("subscribeChannels", map[string]interface{}{"count": 0, "channels": f.getChannels()}))
+	if err != nil {
+		f.Log.Error("subscribe channels request failed: ", err)
 		return false
 	}
 
@@ -182,39 +561,184 @@ func (f *Fems) try_subscribe_channels() bool {
 	return true
 }
 
-func (f *Fems) try_login() bool {
-	loginReq := getRequest("authenticateWithPassword")
-	loginReq.Params = map[string]interface{}{"password": f.Password}
+// try_get_edge_config fetches and caches FEMS's static component/channel
+// metadata, expands channels_from_nature (if configured) into the channel
+// list, and logs an error up front for any configured channel that does not
+// exist rather than waiting for the first "no data" warning.
+func (f *Fems) try_get_edge_config() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRPCTimeout)
+	defer cancel()
 
-	f.Log.Trace("sending login request")
-	err := f.conn.WriteJSON(loginReq)
+	resp, err := f.sendRequest(ctx, "edgeRpc", f.edgeRpcParams("getEdgeConfig", map[string]interface{}{}))
 	if err != nil {
-		f.Log.Error("write:", err)
+		f.Log.Error("getEdgeConfig request failed: ", err)
+		return false
+	}
+	if resp.Error != nil {
+		f.Log.Error("getEdgeConfig failed: ", resp.Error.Code, " - ", resp.Error.Message)
 		return false
 	}
 
-	_, msg, err := f.conn.ReadMessage()
-	if err != nil {
-		f.Log.Info("read login response:", err)
+	var cfg EdgeConfig
+	if err := json.Unmarshal(resp.Result, &cfg); err != nil {
+		f.Log.Error("could not parse getEdgeConfig response: ", err)
 		return false
 	}
+	f.edgeConfig = &cfg
 
-	var loginResp RpcResponse
-	err = json.Unmarshal(msg, &loginResp)
+	if len(f.ChannelsFromNature) > 0 {
+		channels := expandChannelsFromNature(&cfg, f.ChannelsFromNature)
+		if len(channels) == 0 {
+			f.Log.Error("channels_from_nature ", f.ChannelsFromNature, " matched no channels")
+			return false
+		}
+		f.channelsMu.Lock()
+		f.Channels = channels
+		f.channelsMu.Unlock()
+	}
+
+	f.validateChannels(&cfg)
+
+	return true
+}
+
+// expandChannelsFromNature returns every "component/channel" address of
+// components whose natures match any of the requested natures (matched as a
+// case-insensitive substring, e.g. "ess" matches
+// "io.openems.edge.ess.api.SymmetricEss").
+func expandChannelsFromNature(cfg *EdgeConfig, natures []string) []string {
+	var channels []string
+	for componentId, comp := range cfg.Components {
+		if !componentMatchesNature(comp, natures) {
+			continue
+		}
+		for channelName := range comp.Channels {
+			channels = append(channels, componentId+"/"+channelName)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+func componentMatchesNature(comp EdgeComponentConfig, natures []string) bool {
+	for _, nature := range comp.Natures {
+		for _, want := range natures {
+			if strings.Contains(strings.ToLower(nature), strings.ToLower(want)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateChannels logs a hard error for every configured channel that does
+// not exist in cfg, instead of silently warning only once data starts
+// flowing.
+func (f *Fems) validateChannels(cfg *EdgeConfig) {
+	for _, channel := range f.getChannels() {
+		component, short, ok := splitComponentChannel(channel)
+		if !ok {
+			f.Log.Error("channel '", channel, "' is not a valid component/channel address")
+			continue
+		}
+
+		comp, ok := cfg.Components[component]
+		if !ok {
+			f.Log.Error("channel '", channel, "' references unknown component '", component, "'")
+			continue
+		}
+
+		if _, ok := comp.Channels[short]; !ok {
+			f.Log.Error("channel '", channel, "' does not exist on component '", component, "'")
+		}
+	}
+}
+
+func (f *Fems) getChannels() []string {
+	f.channelsMu.Lock()
+	defer f.channelsMu.Unlock()
+	channels := make([]string, len(f.Channels))
+	copy(channels, f.Channels)
+	return channels
+}
+
+// ReloadChannels diffs newChannels against the currently subscribed
+// channels and sends the resulting subscribeChannels/unsubscribeChannels
+// edge-RPCs, then atomically swaps in the new channel list.
+func (f *Fems) ReloadChannels(newChannels []string) error {
+	old := f.getChannels()
+	toAdd, toRemove := diffChannels(old, newChannels)
+	if len(toAdd) == 0 && len(toRemove) == 0 {
+		f.Log.Debug("ReloadChannels: no changes")
+		return nil
+	}
+
+	if len(toRemove) > 0 {
+		unsubCtx, cancel := context.WithTimeout(context.Background(), defaultRPCTimeout)
+		resp, err := f.sendRequest(unsubCtx, "edgeRpc", f.edgeRpcParams("unsubscribeChannels", map[string]interface{}{"channels": toRemove}))
+		cancel()
+		if err != nil {
+			return fmt.Errorf("unsubscribe channels: %w", err)
+		}
+		if resp.Error != nil {
+			return fmt.Errorf("unsubscribe channels failed: %d - %s", resp.Error.Code, resp.Error.Message)
+		}
+	}
+
+	subCtx, cancel := context.WithTimeout(context.Background(), defaultRPCTimeout)
+	defer cancel()
+	resp, err := f.sendRequest(subCtx, "edgeRpc", f.edgeRpcParams("subscribeChannels", map[string]interface{}{"count": 0, "channels": newChannels}))
 	if err != nil {
-		f.Log.Info("could not parse login response:", err)
-		f.Log.Info("data was:", string(msg))
-		return false
+		return fmt.Errorf("subscribe channels: %w", err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("subscribe channels failed: %d - %s", resp.Error.Code, resp.Error.Message)
+	}
+
+	f.channelsMu.Lock()
+	f.Channels = newChannels
+	f.channelsMu.Unlock()
+
+	f.Log.Info("reloaded channels: added ", toAdd, " removed ", toRemove)
+
+	return nil
+}
+
+// diffChannels returns the channels present in newChannels but not old
+// (toAdd) and those present in old but not newChannels (toRemove).
+func diffChannels(old, newChannels []string) (toAdd, toRemove []string) {
+	oldSet := make(map[string]bool, len(old))
+	for _, c := range old {
+		oldSet[c] = true
+	}
+	newSet := make(map[string]bool, len(newChannels))
+	for _, c := range newChannels {
+		newSet[c] = true
+		if !oldSet[c] {
+			toAdd = append(toAdd, c)
+		}
+	}
+	for _, c := range old {
+		if !newSet[c] {
+			toRemove = append(toRemove, c)
+		}
 	}
+	return toAdd, toRemove
+}
+
+func (f *Fems) try_login() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRPCTimeout)
+	defer cancel()
 
-	if loginResp.Id != loginReq.Id {
-		f.Log.Error("unexpected response id: ", loginResp)
+	f.Log.Trace("sending login request")
+	resp, err := f.sendRequest(ctx, "authenticateWithPassword", map[string]interface{}{"password": f.Password})
+	if err != nil {
+		f.Log.Info("login request failed: ", err)
 		return false
 	}
 
-	f.Log.Trace("got login response")
-	if loginResp.Error != nil {
-		f.Log.Error("Login failed: ", loginResp.Error.Code, " - ", loginResp.Error.Message)
+	if resp.Error != nil {
+		f.Log.Error("Login failed: ", resp.Error.Code, " - ", resp.Error.Message)
 		return false
 	}
 
@@ -223,58 +747,297 @@ func (f *Fems) try_login() bool {
 	return true
 }
 
-func (f *Fems) try_handel_msgs_forever() {
+// edgeRpcParams wraps an inner JSON-RPC request (with its own id) in the
+// "edgeRpc" envelope FEMS expects, e.g. for subscribeChannels/
+// unsubscribeChannels/getEdgeConfig.
+func (f *Fems) edgeRpcParams(innerMethod string, innerParams any) map[string]interface{} {
+	inner := getRequest(innerMethod)
+	inner.Params = innerParams
+	return map[string]interface{}{"edgeId": "0", "payload": inner} // edgeId is a string!
+}
+
+// sendRequest writes a JSON-RPC request and blocks until readLoop delivers
+// the matching response, the context expires, or the connection dies.
+func (f *Fems) sendRequest(ctx context.Context, method string, params any) (*RpcResponse, error) {
+	req := getRequest(method)
+	req.Params = params
+
+	ch := make(chan *RpcResponse, 1)
+	f.dispatchMu.Lock()
+	f.pending[req.Id] = ch
+	f.dispatchMu.Unlock()
+	defer func() {
+		f.dispatchMu.Lock()
+		delete(f.pending, req.Id)
+		f.dispatchMu.Unlock()
+	}()
+
+	if err := f.writeJSON(req); err != nil {
+		return nil, fmt.Errorf("write %s: %w", method, err)
+	}
+
+	select {
+	case resp := <-ch:
+		if resp == nil {
+			return nil, errors.New("connection closed while waiting for response")
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readLoop is the single reader goroutine for the connection: every incoming
+// frame is parsed once to tell a response (carries "id") from a notification
+// (carries only "method"), then routed to whoever is waiting for it.
+func (f *Fems) readLoop() {
+	conn := f.getConn()
+	if conn == nil {
+		return
+	}
+
 	for {
-		_, msg, err := f.conn.ReadMessage()
+		_, msg, err := conn.ReadMessage()
 		if err != nil {
 			if f.is_stopping == false {
 				f.Log.Info("read error: ", err)
 			}
+			f.failPending()
 			return
 		}
 
-		var dataEv DataUpdateEvent
-		err = json.Unmarshal(msg, &dataEv)
-		if err != nil {
-			f.Log.Info("could not parse received data:", err)
+		f.dispatch(msg)
+	}
+}
+
+func (f *Fems) dispatch(msg []byte) {
+	var envelope rpcEnvelope
+	if err := json.Unmarshal(msg, &envelope); err != nil {
+		f.Log.Info("could not parse received message:", err)
+		f.Log.Info("data was:", string(msg))
+		return
+	}
+
+	if envelope.Id != "" {
+		var resp RpcResponse
+		if err := json.Unmarshal(msg, &resp); err != nil {
+			f.Log.Info("could not parse response:", err)
 			f.Log.Info("data was:", string(msg))
-			continue
+			return
 		}
-		data := dataEv.EdgRpcParams.Payload.Params
-		f.Log.Trace("FEMS RX: ", data)
 
-		for key, value := range data {
-			if value == nil {
-				f.Log.Warn("no data for channel '", key, "' received. This most likely means the channel does not exist.")
-				delete(data, key)
-			}
+		f.dispatchMu.Lock()
+		ch, ok := f.pending[resp.Id]
+		f.dispatchMu.Unlock()
+		if !ok {
+			f.Log.Warn("received response for unknown or timed-out request id: ", resp.Id)
+			return
 		}
 
-		if len(data) == 0 {
-			f.Log.Warn("No measurement data!!! Original message was: ", string(msg))
+		ch <- &resp
+		return
+	}
+
+	if envelope.Method == "" {
+		f.Log.Warn("received message with neither id nor method: ", string(msg))
+		return
+	}
+
+	f.dispatchMu.Lock()
+	handler, ok := f.handlers[envelope.Method]
+	f.dispatchMu.Unlock()
+	if !ok {
+		f.Log.Trace("no handler registered for notification method ", envelope.Method)
+		return
+	}
+
+	handler(msg)
+}
+
+// failPending unblocks every sendRequest call still waiting on a response,
+// so a dead connection does not leak goroutines stuck until their context
+// times out.
+func (f *Fems) failPending() {
+	f.dispatchMu.Lock()
+	pending := f.pending
+	f.pending = make(map[string]chan *RpcResponse)
+	f.dispatchMu.Unlock()
+
+	for _, ch := range pending {
+		ch <- nil
+	}
+}
+
+// onEdgeRpcNotification handles the "edgeRpc" notification that carries
+// subscribed channel data and forwards it to the accumulator, applying any
+// configured per-channel tags/renaming/unit conversion/type coercion.
+func (f *Fems) onEdgeRpcNotification(msg []byte) {
+	var dataEv DataUpdateEvent
+	if err := json.Unmarshal(msg, &dataEv); err != nil {
+		f.Log.Info("could not parse received data:", err)
+		f.Log.Info("data was:", string(msg))
+		return
+	}
+	data := dataEv.EdgRpcParams.Payload.Params
+	f.Log.Trace("FEMS RX: ", data)
+
+	received := 0
+	for channel, value := range data {
+		if value == nil {
+			f.Log.Warn("no data for channel '", channel, "' received. This most likely means the channel does not exist.")
 			continue
 		}
+		f.emitChannel(channel, value)
+		received++
+	}
 
-		f.acc.AddFields("fems", data, nil)
+	if received == 0 {
+		f.Log.Warn("No measurement data!!! Original message was: ", string(msg))
+		return
 	}
+
+	f.setBackoff(time.Duration(f.ReconnectMinBackoff))
 }
 
-func (f *Fems) cleanup() {
-	if f.conn == nil {
+// emitChannel turns the raw value of a single FEMS channel into a metric,
+// applying the matching ChannelConfig (if any) and the component_tag
+// shortcut, then hands it to the accumulator.
+func (f *Fems) emitChannel(channel string, rawValue any) {
+	measurement := "fems"
+	fieldName := channel
+	var tags map[string]string
+	addTag := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[key] = value
+	}
+
+	component, short, hasComponent := splitComponentChannel(channel)
+	if f.ComponentTag && hasComponent {
+		addTag("component", component)
+		fieldName = short
+	}
+
+	if f.edgeConfig != nil && hasComponent {
+		if comp, ok := f.edgeConfig.Components[component]; ok {
+			addTag("alias", comp.Alias)
+			addTag("component_type", comp.FactoryId)
+			if ch, ok := comp.Channels[short]; ok {
+				addTag("unit", ch.Unit)
+			}
+		}
+	}
+
+	cfg, hasConfig := f.channelConfig[channel]
+	if hasConfig {
+		if cfg.Measurement != "" {
+			measurement = cfg.Measurement
+		}
+		if cfg.Rename != "" {
+			fieldName = cfg.Rename
+		}
+		for k, v := range cfg.Tags {
+			addTag(k, v)
+		}
+	}
+
+	value, err := convertChannelValue(rawValue, cfg.Type, cfg.Scale, cfg.Offset)
+	if err != nil {
+		f.Log.Warn("could not convert channel '", channel, "' value '", rawValue, "': ", err)
 		return
 	}
 
-	f.conn.Close()
-	f.conn = nil
-	f.Log.Info("connection closed")
+	f.acc.AddFields(measurement, map[string]interface{}{fieldName: value}, tags)
 }
 
-func (f *Fems) get_subscribe_channels_request() RpcReq {
+// splitComponentChannel splits a FEMS channel address of the form
+// "component/channel" into its component and short-channel-name parts.
+func splitComponentChannel(channel string) (component, short string, ok bool) {
+	parts := strings.SplitN(channel, "/", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
 
-	edgeRpc := getRequest("edgeRpc")
-	subsRpc := getRequest("subscribeChannels")
-	subsRpc.Params = map[string]interface{}{"count": 0, "channels": f.Channels}
-	edgeRpc.Params = map[string]interface{}{"edgeId": "0", "payload": subsRpc} // edgeId is a string!
+// convertChannelValue applies scale/offset (if non-zero) and then coerces
+// the result to typ ("" leaves the value as FEMS sent it unless scale or
+// offset forced a numeric conversion).
+func convertChannelValue(raw any, typ string, scale, offset float64) (interface{}, error) {
+	if scale != 0 || offset != 0 {
+		n, err := toFloat64(raw)
+		if err != nil {
+			return nil, err
+		}
+		if scale != 0 {
+			n *= scale
+		}
+		raw = n + offset
+		if typ == "" {
+			typ = "float"
+		}
+	}
 
-	return edgeRpc
+	switch typ {
+	case "":
+		return raw, nil
+	case "float":
+		return toFloat64(raw)
+	case "integer":
+		n, err := toFloat64(raw)
+		if err != nil {
+			return nil, err
+		}
+		return int64(n), nil
+	case "string":
+		return fmt.Sprintf("%v", raw), nil
+	case "boolean":
+		return toBool(raw)
+	default:
+		return nil, fmt.Errorf("unknown channel type %q", typ)
+	}
+}
+
+func toFloat64(raw any) (float64, error) {
+	switch v := raw.(type) {
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("cannot convert %T to a number", raw)
+	}
+}
+
+func toBool(raw any) (bool, error) {
+	switch v := raw.(type) {
+	case bool:
+		return v, nil
+	case float64:
+		return v != 0, nil
+	case string:
+		return strconv.ParseBool(v)
+	default:
+		return false, fmt.Errorf("cannot convert %T to a boolean", raw)
+	}
+}
+
+func (f *Fems) cleanup() {
+	conn := f.getConn()
+	if conn == nil {
+		return
+	}
+
+	conn.Close()
+	f.setConn(nil)
+	f.Log.Info("connection closed")
 }
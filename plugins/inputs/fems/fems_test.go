@@ -0,0 +1,221 @@
+package fems
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJitter(t *testing.T) {
+	wait := 10 * time.Second
+	for i := 0; i < 100; i++ {
+		got := jitter(wait)
+		require.GreaterOrEqual(t, got, 7500*time.Millisecond)
+		require.LessOrEqual(t, got, 12500*time.Millisecond)
+	}
+}
+
+func TestSplitComponentChannel(t *testing.T) {
+	tests := []struct {
+		name          string
+		channel       string
+		wantComponent string
+		wantShort     string
+		wantOk        bool
+	}{
+		{"component and channel", "_sum/EssActivePower", "_sum", "EssActivePower", true},
+		{"nested channel name", "meter0/Ess/ActivePower", "meter0", "Ess/ActivePower", true},
+		{"no separator", "EssActivePower", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			component, short, ok := splitComponentChannel(tt.channel)
+			require.Equal(t, tt.wantOk, ok)
+			require.Equal(t, tt.wantComponent, component)
+			require.Equal(t, tt.wantShort, short)
+		})
+	}
+}
+
+func TestDiffChannels(t *testing.T) {
+	toAdd, toRemove := diffChannels(
+		[]string{"_sum/EssSoc", "_sum/GridActivePower"},
+		[]string{"_sum/GridActivePower", "_sum/EssActivePower"},
+	)
+	require.ElementsMatch(t, []string{"_sum/EssActivePower"}, toAdd)
+	require.ElementsMatch(t, []string{"_sum/EssSoc"}, toRemove)
+}
+
+func TestDiffChannelsNoChange(t *testing.T) {
+	toAdd, toRemove := diffChannels(
+		[]string{"_sum/EssSoc"},
+		[]string{"_sum/EssSoc"},
+	)
+	require.Empty(t, toAdd)
+	require.Empty(t, toRemove)
+}
+
+func TestConvertChannelValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     any
+		typ     string
+		scale   float64
+		offset  float64
+		want    interface{}
+		wantErr bool
+	}{
+		{"no type passes value through", "unchanged", "", 0, 0, "unchanged", false},
+		{"float passthrough", 1.5, "float", 0, 0, 1.5, false},
+		{"coerce to integer", 41.9, "integer", 0, 0, int64(41), false},
+		{"coerce to string", 42.0, "string", 0, 0, "42", false},
+		{"coerce to boolean", 1.0, "boolean", 0, 0, true, false},
+		{"scale without explicit type defaults to float", 10.0, "", 0.1, 0, 1.0, false},
+		{"scale and offset applied before coercion", 10.0, "integer", 2, 3, int64(23), false},
+		{"unknown type errors", 1.0, "enum", 0, 0, nil, true},
+		{"non-numeric value with scale errors", "not-a-number", "", 1, 0, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := convertChannelValue(tt.raw, tt.typ, tt.scale, tt.offset)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestToFloat64(t *testing.T) {
+	v, err := toFloat64(float64(3.5))
+	require.NoError(t, err)
+	require.Equal(t, 3.5, v)
+
+	v, err = toFloat64("2.5")
+	require.NoError(t, err)
+	require.Equal(t, 2.5, v)
+
+	v, err = toFloat64(true)
+	require.NoError(t, err)
+	require.Equal(t, 1.0, v)
+
+	_, err = toFloat64([]int{1})
+	require.Error(t, err)
+}
+
+func TestToBool(t *testing.T) {
+	v, err := toBool(true)
+	require.NoError(t, err)
+	require.True(t, v)
+
+	v, err = toBool(float64(0))
+	require.NoError(t, err)
+	require.False(t, v)
+
+	v, err = toBool("true")
+	require.NoError(t, err)
+	require.True(t, v)
+
+	_, err = toBool([]int{1})
+	require.Error(t, err)
+}
+
+func TestExpandChannelsFromNature(t *testing.T) {
+	cfg := &EdgeConfig{
+		Components: map[string]EdgeComponentConfig{
+			"ess0": {
+				Natures: []string{"io.openems.edge.ess.api.SymmetricEss"},
+				Channels: map[string]EdgeChannelConfig{
+					"Soc":         {},
+					"ActivePower": {},
+				},
+			},
+			"meter0": {
+				Natures: []string{"io.openems.edge.meter.api.SymmetricMeter"},
+				Channels: map[string]EdgeChannelConfig{
+					"ActivePower": {},
+				},
+			},
+			"io0": {
+				Natures:  []string{"io.openems.edge.io.api.DigitalOutput"},
+				Channels: map[string]EdgeChannelConfig{"Output1": {}},
+			},
+		},
+	}
+
+	got := expandChannelsFromNature(cfg, []string{"ess", "meter"})
+	require.ElementsMatch(t, []string{"ess0/Soc", "ess0/ActivePower", "meter0/ActivePower"}, got)
+}
+
+func TestComponentMatchesNature(t *testing.T) {
+	comp := EdgeComponentConfig{Natures: []string{"io.openems.edge.ess.api.SymmetricEss"}}
+	require.True(t, componentMatchesNature(comp, []string{"ESS"}))
+	require.False(t, componentMatchesNature(comp, []string{"meter"}))
+}
+
+// TestSendRequestRoundTrip drives try_login and try_subscribe_channels
+// against a fake FEMS websocket server to prove that sendRequest's request
+// actually gets matched back up with readLoop's response instead of just
+// blocking until its context times out (the failure mode of the chunk0-3
+// handshake deadlock).
+func TestSendRequestRoundTrip(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			var req RpcReq
+			require.NoError(t, json.Unmarshal(msg, &req))
+			require.NoError(t, conn.WriteJSON(map[string]interface{}{
+				"jsonrpc": "2.0",
+				"id":      req.Id,
+				"result":  map[string]interface{}{},
+			}))
+		}
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	f := &Fems{
+		URL:      "example.invalid",
+		Channels: []string{"_sum/EssSoc"},
+		Log:      testutil.Logger{},
+	}
+	require.NoError(t, f.Init())
+	f.setConn(ws)
+
+	readDone := make(chan struct{})
+	go func() {
+		f.readLoop()
+		close(readDone)
+	}()
+	defer func() {
+		ws.Close()
+		<-readDone
+	}()
+
+	require.True(t, f.try_login())
+	require.True(t, f.try_subscribe_channels())
+}